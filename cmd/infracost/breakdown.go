@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/infracost/infracost/internal/config"
+)
+
+// newBreakdownCommand builds the "breakdown" command and registers its --path
+// flag along with the Terragrunt-specific flags, all bound onto projectConfig,
+// which is where TerragruntProvider reads them from.
+func newBreakdownCommand(projectConfig *config.ProjectConfig) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "breakdown",
+		Short: "Show full breakdown of costs",
+	}
+
+	cmd.Flags().StringVar(&projectConfig.Path, "path", "",
+		"Path to the Terraform/Terragrunt directory")
+
+	addTerragruntParallelismFlag(cmd, projectConfig)
+	addTerragruntFilterFlag(cmd, projectConfig)
+
+	return cmd
+}
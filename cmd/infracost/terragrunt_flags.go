@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/infracost/infracost/internal/config"
+)
+
+// addTerragruntParallelismFlag registers --terragrunt-parallelism and binds
+// it onto projectConfig so it's picked up by internal/providers/terraform
+// without any further plumbing.
+func addTerragruntParallelismFlag(cmd *cobra.Command, projectConfig *config.ProjectConfig) {
+	cmd.Flags().IntVar(&projectConfig.TerragruntParallelism, "terragrunt-parallelism", 0,
+		"Number of Terragrunt config dirs to run terragrunt show on concurrently (default 8)")
+}
+
+// addTerragruntFilterFlag registers --terragrunt-filter and binds it onto
+// projectConfig so it's picked up by internal/providers/terraform without
+// any further plumbing.
+func addTerragruntFilterFlag(cmd *cobra.Command, projectConfig *config.ProjectConfig) {
+	cmd.Flags().StringVar(&projectConfig.TerragruntFilter, "terragrunt-filter", "",
+		"Comma-separated list of paths or doublestar globs, relative to the project path, that scopes the run to a subset of Terragrunt units")
+}
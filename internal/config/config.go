@@ -0,0 +1,69 @@
+package config
+
+import "context"
+
+// Config holds the global run configuration shared across all projects in
+// an Infracost run.
+type Config struct {
+	EnableDashboard bool
+}
+
+// RunContext wraps the global Config for a single Infracost invocation.
+type RunContext struct {
+	Config *Config
+}
+
+// ProjectContext wraps a single project's config alongside the run-wide
+// context, and is threaded through provider construction.
+type ProjectContext struct {
+	RunContext    *RunContext
+	ProjectConfig *ProjectConfig
+}
+
+// ProjectConfig holds the settings for a single project, populated from CLI
+// flags and/or the Infracost config file.
+type ProjectConfig struct {
+	Path            string
+	TerraformBinary string
+
+	// TerragruntParallelism caps how many Terragrunt config dirs
+	// TerragruntProvider runs `terragrunt show` on concurrently. See
+	// --terragrunt-parallelism.
+	TerragruntParallelism int
+
+	// TerragruntHooks lets an embedder observe and react to each phase of a
+	// TerragruntProvider run. There is no CLI flag for this; it's set when
+	// Infracost is used as a Go library.
+	TerragruntHooks *TerragruntHooks
+
+	// TerragruntFilter scopes a Terragrunt run to a subset of units, as a
+	// comma-separated list of paths or doublestar globs relative to Path.
+	// See --terragrunt-filter.
+	TerragruntFilter string
+}
+
+// TerragruntPhase identifies a stage of TerragruntProvider's workflow that
+// lifecycle hooks can observe. Defined here, rather than in the terraform
+// provider package, so ProjectConfig can reference it without an import
+// cycle (the terraform package already imports config).
+type TerragruntPhase string
+
+const (
+	TerragruntPhaseTerragruntInfo TerragruntPhase = "terragrunt-info"
+	TerragruntPhasePlan           TerragruntPhase = "plan"
+	TerragruntPhaseShow           TerragruntPhase = "show"
+	TerragruntPhaseState          TerragruntPhase = "state"
+)
+
+// TerragruntHooks lets callers observe and react to each phase of
+// TerragruntProvider's run. BeforeRun/AfterRun surround a phase, and OnError
+// is called with the phase's error before it is returned, so integrations
+// can snapshot the working dir, upload the failed plan JSON to an artifact
+// store, or emit telemetry. OnError cannot change what's returned to the
+// caller: the original error is always returned as-is, and if OnError itself
+// returns a non-nil error, that's only logged as a warning.
+type TerragruntHooks struct {
+	BeforeRun func(ctx context.Context, phase TerragruntPhase) error
+	AfterRun  func(ctx context.Context, phase TerragruntPhase) error
+	OnError   func(ctx context.Context, phase TerragruntPhase, err error) error
+}
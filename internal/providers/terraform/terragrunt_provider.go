@@ -2,20 +2,62 @@ package terraform
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 
+	"github.com/bmatcuk/doublestar/v4"
 	"github.com/infracost/infracost/internal/config"
 	"github.com/infracost/infracost/internal/schema"
 	"github.com/infracost/infracost/internal/ui"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 )
 
 var defaultTerragruntBinary = "terragrunt"
 var minTerragruntVer = "v0.28.1"
 
+// defaultTerragruntParallelism is used when ProjectConfig.TerragruntParallelism
+// is not set. It caps the number of Terragrunt config dirs that are run
+// through `terragrunt show` concurrently.
+const defaultTerragruntParallelism = 8
+
+// TerragruntPhase identifies a stage of the Terragrunt provider's workflow
+// that lifecycle hooks can observe. Aliased from the config package so
+// ProjectConfig.TerragruntHooks can reference it without an import cycle.
+type TerragruntPhase = config.TerragruntPhase
+
+const (
+	PhaseTerragruntInfo = config.TerragruntPhaseTerragruntInfo
+	PhasePlan           = config.TerragruntPhasePlan
+	PhaseShow           = config.TerragruntPhaseShow
+	PhaseState          = config.TerragruntPhaseState
+)
+
+// TerragruntHooks lets callers observe and react to each phase of the
+// Terragrunt provider's run. See config.TerragruntHooks for details.
+type TerragruntHooks = config.TerragruntHooks
+
+// TerragruntProvider delegates an entire run-all invocation (plan or show) to
+// the terragrunt binary rather than resolving each unit's Terraform graph
+// itself, so it has no hook into how the subprocess resolves individual
+// `dependency` blocks. An in-process cache for dependency outputs (keyed by
+// upstream config dir, collapsed with singleflight, optionally reading
+// straight from the upstream unit's remote state instead of shelling out)
+// was attempted and then dropped for exactly this reason: there is no call
+// site inside this provider where a per-dependency output is ever resolved
+// to memoize. Revisiting this would require TerragruntProvider to stop
+// delegating whole `run-all` invocations and instead drive each unit's plan
+// itself, which is a materially different architecture than the one here.
 type TerragruntProvider struct {
 	ctx  *config.ProjectContext
 	Path string
@@ -23,8 +65,11 @@ type TerragruntProvider struct {
 }
 
 type TerragruntInfo struct {
-	ConfigPath string
-	WorkingDir string
+	ConfigPath      string
+	WorkingDir      string
+	TerraformBinary string
+	IamRole         string
+	DownloadDir     string
 }
 
 func NewTerragruntProvider(ctx *config.ProjectContext) schema.Provider {
@@ -61,7 +106,7 @@ func (p *TerragruntProvider) LoadResources(usage map[string]*schema.UsageData) (
 	// We want to run Terragrunt commands from the config dirs
 	// Terragrunt internally runs Terraform in the working dirs, so we need to be aware of these
 	// so we can handle reading and cleaning up the generated plan files.
-	configDirs, workingDirs, err := p.getProjectDirs()
+	configDirs, workingDirs, downloadDirs, totalUnits, err := p.getProjectDirs()
 
 	if err != nil {
 		return []*schema.Project{}, err
@@ -72,7 +117,7 @@ func (p *TerragruntProvider) LoadResources(usage map[string]*schema.UsageData) (
 	if p.UseState {
 		outs, err = p.generateStateJSONs(configDirs)
 	} else {
-		outs, err = p.generatePlanJSONs(configDirs, workingDirs)
+		outs, err = p.generatePlanJSONs(configDirs, workingDirs, downloadDirs, totalUnits)
 	}
 	if err != nil {
 		return []*schema.Project{}, err
@@ -106,44 +151,272 @@ func (p *TerragruntProvider) LoadResources(usage map[string]*schema.UsageData) (
 	return projects, nil
 }
 
-func (p *TerragruntProvider) getProjectDirs() ([]string, []string, error) {
+// getProjectDirs returns the matching Terragrunt config dirs, their working
+// dirs and download dirs, and the total number of units Terragrunt reported
+// before any --terragrunt-filter was applied (so callers can show how many
+// units were selected out of the total).
+func (p *TerragruntProvider) getProjectDirs() ([]string, []string, []string, int, error) {
 	spinner := ui.NewSpinner("Running terragrunt run-all terragrunt-info", p.spinnerOpts)
 
+	ctx := context.Background()
+	if err := p.runBeforeRunHook(ctx, PhaseTerragruntInfo); err != nil {
+		spinner.Fail()
+		return []string{}, []string{}, []string{}, 0, p.runErrorCallback(PhaseTerragruntInfo, ctx, err)
+	}
+
+	filterPatterns := parseTerragruntFilter(p.ctx.ProjectConfig.TerragruntFilter)
+
+	args := []string{"run-all", "--terragrunt-ignore-external-dependencies", "terragrunt-info"}
+
 	opts := &CmdOptions{
 		TerraformBinary: p.TerraformBinary,
 		Dir:             p.Path,
 	}
-	out, err := Cmd(opts, "run-all", "--terragrunt-ignore-external-dependencies", "terragrunt-info")
+	out, err := Cmd(opts, args...)
 	if err != nil {
 		spinner.Fail()
 		p.printTerraformErr(err)
 
-		return []string{}, []string{}, err
+		return []string{}, []string{}, []string{}, 0, p.runErrorCallback(PhaseTerragruntInfo, ctx, err)
+	}
+
+	infos, err := parseTerragruntInfoOutput(out)
+	if err != nil {
+		spinner.Fail()
+		return []string{}, []string{}, []string{}, 0, p.runErrorCallback(PhaseTerragruntInfo, ctx, err)
+	}
+
+	configDirs := make([]string, 0, len(infos))
+	workingDirs := make([]string, 0, len(infos))
+	downloadDirs := make([]string, 0, len(infos))
+
+	for _, info := range infos {
+		dir := filepath.Dir(info.ConfigPath)
+
+		configDirs = append(configDirs, dir)
+		workingDirs = append(workingDirs, info.WorkingDir)
+		downloadDirs = append(downloadDirs, info.DownloadDir)
+	}
+
+	totalUnits := len(configDirs)
+
+	configDirs, workingDirs, downloadDirs, err = filterProjectDirs(p.Path, configDirs, workingDirs, downloadDirs, filterPatterns)
+	if err != nil {
+		spinner.Fail()
+		return []string{}, []string{}, []string{}, 0, p.runErrorCallback(PhaseTerragruntInfo, ctx, err)
+	}
+
+	spinner.Success()
+
+	if err := p.runAfterRunHook(ctx, PhaseTerragruntInfo); err != nil {
+		return configDirs, workingDirs, downloadDirs, totalUnits, p.runErrorCallback(PhaseTerragruntInfo, ctx, err)
+	}
+
+	return configDirs, workingDirs, downloadDirs, totalUnits, nil
+}
+
+// parseTerragruntFilter splits a --terragrunt-filter expression into its
+// individual comma-separated path/glob patterns.
+func parseTerragruntFilter(expr string) []string {
+	if strings.TrimSpace(expr) == "" {
+		return nil
+	}
+
+	var patterns []string
+	for _, pattern := range strings.Split(expr, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	return patterns
+}
+
+// terragruntFilterCLIArgs builds the extra run-all flags that make Terragrunt
+// itself skip units excluded by patterns, so we don't pay for a plan just to
+// throw it away client-side.
+func terragruntFilterCLIArgs(patterns []string) []string {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	args := []string{"--terragrunt-include-external-dependencies=false", "--terragrunt-strict-include"}
+	for _, pattern := range patterns {
+		args = append(args, "--terragrunt-include-dir", pattern)
+	}
+
+	return args
+}
+
+// filterProjectDirs keeps only the configDirs (and their corresponding
+// workingDirs/downloadDirs) whose path relative to basePath matches one of
+// patterns. An empty patterns list is a no-op.
+func filterProjectDirs(basePath string, configDirs, workingDirs, downloadDirs []string, patterns []string) ([]string, []string, []string, error) {
+	if len(patterns) == 0 {
+		return configDirs, workingDirs, downloadDirs, nil
+	}
+
+	filteredConfigDirs := make([]string, 0, len(configDirs))
+	filteredWorkingDirs := make([]string, 0, len(configDirs))
+	filteredDownloadDirs := make([]string, 0, len(configDirs))
+
+	for i, dir := range configDirs {
+		rel, err := filepath.Rel(basePath, dir)
+		if err != nil {
+			rel = dir
+		}
+		rel = filepath.ToSlash(rel)
+
+		for _, pattern := range patterns {
+			ok, err := doublestar.Match(pattern, rel)
+			if err != nil {
+				return nil, nil, nil, errors.Wrapf(err, "invalid terragrunt filter pattern %q", pattern)
+			}
+			if ok {
+				filteredConfigDirs = append(filteredConfigDirs, dir)
+				filteredWorkingDirs = append(filteredWorkingDirs, workingDirs[i])
+				filteredDownloadDirs = append(filteredDownloadDirs, downloadDirs[i])
+				break
+			}
+		}
+	}
+
+	if len(filteredConfigDirs) == 0 {
+		return nil, nil, nil, fmt.Errorf("terragrunt filter %q matched 0 of %d units", strings.Join(patterns, ","), len(configDirs))
 	}
 
-	jsons := bytes.SplitAfter(out, []byte{'}', '\n'})
-	if len(jsons) > 1 {
-		jsons = jsons[:len(jsons)-1]
+	return filteredConfigDirs, filteredWorkingDirs, filteredDownloadDirs, nil
+}
+
+// parseTerragruntInfoOutput parses the stdout of `terragrunt run-all
+// terragrunt-info`. Depending on the Terragrunt version this is either a
+// single top-level JSON array, or one JSON object per unit concatenated on
+// stdout and potentially interleaved with non-JSON log lines, so we decode it
+// one JSON value at a time, skipping ahead to the next '{' past anything that
+// fails to decode, rather than splitting on "}\n".
+func parseTerragruntInfoOutput(out []byte) ([]TerragruntInfo, error) {
+	trimmed := bytes.TrimLeft(out, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var infos []TerragruntInfo
+		if err := json.Unmarshal(trimmed, &infos); err != nil {
+			return nil, err
+		}
+
+		return infos, nil
 	}
 
-	configDirs := make([]string, 0, len(jsons))
-	workingDirs := make([]string, 0, len(jsons))
+	var infos []TerragruntInfo
+	remaining := trimmed
+
+	for len(bytes.TrimSpace(remaining)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(remaining))
 
-	for _, j := range jsons {
 		var info TerragruntInfo
-		err = json.Unmarshal(j, &info)
+		err := dec.Decode(&info)
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			spinner.Fail()
-			return configDirs, workingDirs, err
+			log.Debugf("Skipping non-JSON terragrunt-info output: %v", err)
+
+			next := bytes.IndexByte(remaining[1:], '{')
+			if next == -1 {
+				break
+			}
+			remaining = remaining[1+next:]
+			continue
 		}
 
-		configDirs = append(configDirs, filepath.Dir(info.ConfigPath))
-		workingDirs = append(workingDirs, info.WorkingDir)
+		infos = append(infos, info)
+		remaining = remaining[dec.InputOffset():]
 	}
 
-	spinner.Success()
+	return infos, nil
+}
+
+// terragruntParallelism returns the number of Terragrunt config dirs that can
+// be run through `terragrunt show` concurrently, falling back to defaultTerragruntParallelism
+// when the user hasn't configured one.
+func (p *DirProvider) terragruntParallelism() int64 {
+	n := p.ctx.ProjectConfig.TerragruntParallelism
+	if n <= 0 {
+		return defaultTerragruntParallelism
+	}
+	return int64(n)
+}
 
-	return configDirs, workingDirs, nil
+// hooks returns the TerragruntHooks registered on the ProjectConfig, or a
+// zero value if none were registered so callers don't have to nil-check.
+func (p *DirProvider) hooks() TerragruntHooks {
+	if h := p.ctx.ProjectConfig.TerragruntHooks; h != nil {
+		return *h
+	}
+	return TerragruntHooks{}
+}
+
+func (p *DirProvider) runBeforeRunHook(ctx context.Context, phase TerragruntPhase) error {
+	if h := p.hooks().BeforeRun; h != nil {
+		return h(ctx, phase)
+	}
+	return nil
+}
+
+func (p *DirProvider) runAfterRunHook(ctx context.Context, phase TerragruntPhase) error {
+	if h := p.hooks().AfterRun; h != nil {
+		return h(ctx, phase)
+	}
+	return nil
+}
+
+// runErrorCallback invokes the OnError hook (if any) for phase and always
+// returns the original err so callers can write `return p.runErrorCallback(phase, ctx, err)`
+// in place of a bare `return err`. A failing hook is logged rather than
+// swallowing the original error.
+func (p *DirProvider) runErrorCallback(phase TerragruntPhase, ctx context.Context, err error) error {
+	if h := p.hooks().OnError; h != nil {
+		if hookErr := h(ctx, phase, err); hookErr != nil {
+			log.Warnf("Terragrunt %s OnError hook failed: %v", phase, hookErr)
+		}
+	}
+	return err
+}
+
+// progressSpinner wraps a ui.Spinner with a "done/total" counter so that
+// concurrent workers can report progress through a single spinner instance
+// instead of each spawning their own.
+type progressSpinner struct {
+	mu     sync.Mutex
+	prefix string
+	total  int
+	done   int
+	spin   *ui.Spinner
+}
+
+func newProgressSpinner(prefix string, total int, opts ui.SpinnerOptions) *progressSpinner {
+	p := &progressSpinner{prefix: prefix, total: total}
+	p.spin = ui.NewSpinner(p.text(), opts)
+	return p
+}
+
+func (p *progressSpinner) text() string {
+	return p.prefix + ": " + strconv.Itoa(p.done) + "/" + strconv.Itoa(p.total)
+}
+
+func (p *progressSpinner) increment() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done++
+	p.spin.UpdateSpinnerMsg(p.text())
+}
+
+func (p *progressSpinner) Fail() {
+	p.spin.Fail()
+}
+
+func (p *progressSpinner) Success() {
+	p.spin.Success()
 }
 
 func (p *TerragruntProvider) generateStateJSONs(configDirs []string) ([][]byte, error) {
@@ -152,34 +425,71 @@ func (p *TerragruntProvider) generateStateJSONs(configDirs []string) ([][]byte,
 		return [][]byte{}, err
 	}
 
-	outs := make([][]byte, 0, len(configDirs))
+	outs := make([][]byte, len(configDirs))
 
 	spinnerMsg := "Running terragrunt show"
 	if len(configDirs) > 1 {
 		spinnerMsg += " for each project"
 	}
-	spinner := ui.NewSpinner(spinnerMsg, p.spinnerOpts)
+	spinner := newProgressSpinner(spinnerMsg, len(configDirs), p.spinnerOpts)
 
-	for _, path := range configDirs {
-		opts, err := p.buildCommandOpts(path)
-		if err != nil {
-			return [][]byte{}, err
-		}
-		if opts.TerraformConfigFile != "" {
-			defer os.Remove(opts.TerraformConfigFile)
-		}
+	var sfg singleflight.Group
+	sem := semaphore.NewWeighted(p.terragruntParallelism())
+	g, ctx := errgroup.WithContext(context.Background())
 
-		out, err := p.runShow(opts, spinner, "")
-		if err != nil {
-			return outs, err
+	if err := p.runBeforeRunHook(ctx, PhaseState); err != nil {
+		spinner.Fail()
+		return outs, p.runErrorCallback(PhaseState, ctx, err)
+	}
+
+	for i, path := range configDirs {
+		i, path := i, path
+
+		if err := sem.Acquire(ctx, 1); err != nil {
+			break
 		}
-		outs = append(outs, out)
+
+		g.Go(func() error {
+			defer sem.Release(1)
+
+			optsIface, err, _ := sfg.Do(path, func() (interface{}, error) {
+				return p.buildCommandOpts(path)
+			})
+			if err != nil {
+				return err
+			}
+			opts := optsIface.(*CmdOptions)
+			if opts.TerraformConfigFile != "" {
+				defer os.Remove(opts.TerraformConfigFile)
+			}
+
+			out, err := p.runShow(opts, spinner.spin, "")
+			if err != nil {
+				return err
+			}
+
+			outs[i] = out
+			spinner.increment()
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		spinner.Fail()
+		return outs, p.runErrorCallback(PhaseState, ctx, err)
+	}
+
+	spinner.Success()
+
+	if err := p.runAfterRunHook(ctx, PhaseState); err != nil {
+		return outs, p.runErrorCallback(PhaseState, ctx, err)
 	}
 
 	return outs, nil
 }
 
-func (p *DirProvider) generatePlanJSONs(configDirs []string, workingDirs []string) ([][]byte, error) {
+func (p *DirProvider) generatePlanJSONs(configDirs []string, workingDirs []string, downloadDirs []string, totalUnits int) ([][]byte, error) {
 	err := p.checks()
 	if err != nil {
 		return [][]byte{}, err
@@ -193,57 +503,133 @@ func (p *DirProvider) generatePlanJSONs(configDirs []string, workingDirs []strin
 		defer os.Remove(opts.TerraformConfigFile)
 	}
 
-	spinner := ui.NewSpinner("Running terragrunt run-all plan", p.spinnerOpts)
+	// Pass --terragrunt-include-dir flags built from the same filter patterns
+	// that getProjectDirs matched configDirs against, so Terragrunt itself
+	// skips excluded units during run-all plan instead of us planning
+	// everything and discarding the excluded outputs client-side.
+	filterPatterns := parseTerragruntFilter(p.ctx.ProjectConfig.TerragruntFilter)
+	opts.ExtraArgs = append(opts.ExtraArgs, terragruntFilterCLIArgs(filterPatterns)...)
+
+	reqCtx := context.Background()
+	if err := p.runBeforeRunHook(reqCtx, PhasePlan); err != nil {
+		return [][]byte{}, p.runErrorCallback(PhasePlan, reqCtx, err)
+	}
+
+	planSpinnerMsg := "Running terragrunt run-all plan"
+	if totalUnits > 0 && totalUnits != len(configDirs) {
+		planSpinnerMsg += fmt.Sprintf(" on %d/%d units", len(configDirs), totalUnits)
+	}
+	spinner := ui.NewSpinner(planSpinnerMsg, p.spinnerOpts)
 	planFile, planJSON, err := p.runPlan(opts, spinner, true)
 	defer func() {
-		err := cleanupPlanFiles(workingDirs, planFile)
+		err := cleanupPlanFiles(workingDirs, downloadDirs, planFile)
 		if err != nil {
 			log.Warnf("Error cleaning up plan files: %v", err)
 		}
 	}()
 
 	if err != nil {
-		return [][]byte{}, err
+		return [][]byte{}, p.runErrorCallback(PhasePlan, reqCtx, err)
+	}
+
+	if err := p.runAfterRunHook(reqCtx, PhasePlan); err != nil {
+		return [][]byte{}, p.runErrorCallback(PhasePlan, reqCtx, err)
 	}
 
 	if len(planJSON) > 0 {
 		return [][]byte{planJSON}, nil
 	}
 
-	outs := make([][]byte, 0, len(configDirs))
+	outs := make([][]byte, len(configDirs))
 	spinnerMsg := "Running terragrunt show"
 	if len(configDirs) > 1 {
 		spinnerMsg += " for each project"
 	}
-	spinner = ui.NewSpinner(spinnerMsg, p.spinnerOpts)
+	progress := newProgressSpinner(spinnerMsg, len(configDirs), p.spinnerOpts)
+
+	var sfg singleflight.Group
+	sem := semaphore.NewWeighted(p.terragruntParallelism())
+	g, ctx := errgroup.WithContext(reqCtx)
+
+	if err := p.runBeforeRunHook(ctx, PhaseShow); err != nil {
+		progress.Fail()
+		return outs, p.runErrorCallback(PhaseShow, ctx, err)
+	}
 
 	for i, path := range configDirs {
-		opts, err := p.buildCommandOpts(path)
-		if err != nil {
-			return [][]byte{}, err
-		}
-		if opts.TerraformConfigFile != "" {
-			defer os.Remove(opts.TerraformConfigFile)
-		}
+		i, path := i, path
 
-		out, err := p.runShow(opts, spinner, filepath.Join(workingDirs[i], planFile))
-		if err != nil {
-			return outs, err
+		if err := sem.Acquire(ctx, 1); err != nil {
+			break
 		}
-		outs = append(outs, out)
+
+		g.Go(func() error {
+			defer sem.Release(1)
+
+			optsIface, err, _ := sfg.Do(path, func() (interface{}, error) {
+				return p.buildCommandOpts(path)
+			})
+			if err != nil {
+				return err
+			}
+			opts := optsIface.(*CmdOptions)
+			if opts.TerraformConfigFile != "" {
+				defer os.Remove(opts.TerraformConfigFile)
+			}
+
+			out, err := p.runShow(opts, progress.spin, filepath.Join(workingDirs[i], planFile))
+			if err != nil {
+				return err
+			}
+
+			outs[i] = out
+			progress.increment()
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		progress.Fail()
+		return outs, p.runErrorCallback(PhaseShow, ctx, err)
+	}
+
+	progress.Success()
+
+	if err := p.runAfterRunHook(ctx, PhaseShow); err != nil {
+		return outs, p.runErrorCallback(PhaseShow, ctx, err)
 	}
 
 	return outs, nil
 }
 
-func cleanupPlanFiles(paths []string, planFile string) error {
+// cleanupPlanFiles removes the generated plan file from each unit's working
+// dir. Newer Terragrunt versions can run Terraform out of a download dir
+// (e.g. .terragrunt-cache) that diverges from the working dir reported by
+// terragrunt-info, so we also clean that up to avoid leaking plan files
+// there.
+func cleanupPlanFiles(workingDirs []string, downloadDirs []string, planFile string) error {
 	if planFile == "" {
 		return nil
 	}
 
-	for _, path := range paths {
+	for i, path := range workingDirs {
 		err := os.Remove(filepath.Join(path, planFile))
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if i >= len(downloadDirs) {
+			continue
+		}
+
+		downloadDir := downloadDirs[i]
+		if downloadDir == "" || downloadDir == path {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(downloadDir, planFile))
+		if err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
@@ -0,0 +1,225 @@
+package terraform
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func writeFile(t *testing.T, path string, contents string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatalf("failed writing %s: %v", path, err)
+	}
+}
+
+func assertRemoved(t *testing.T, path string) {
+	t.Helper()
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, stat err: %v", path, err)
+	}
+}
+
+func TestParseTerragruntInfoOutput(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []TerragruntInfo
+	}{
+		{
+			name: "single json array",
+			out: `[
+				{"ConfigPath": "/a/terragrunt.hcl", "WorkingDir": "/a"},
+				{"ConfigPath": "/b/terragrunt.hcl", "WorkingDir": "/b"}
+			]`,
+			want: []TerragruntInfo{
+				{ConfigPath: "/a/terragrunt.hcl", WorkingDir: "/a"},
+				{ConfigPath: "/b/terragrunt.hcl", WorkingDir: "/b"},
+			},
+		},
+		{
+			name: "concatenated objects",
+			out: `{"ConfigPath": "/a/terragrunt.hcl", "WorkingDir": "/a"}
+				{"ConfigPath": "/b/terragrunt.hcl", "WorkingDir": "/b"}`,
+			want: []TerragruntInfo{
+				{ConfigPath: "/a/terragrunt.hcl", WorkingDir: "/a"},
+				{ConfigPath: "/b/terragrunt.hcl", WorkingDir: "/b"},
+			},
+		},
+		{
+			name: "objects interleaved with log noise",
+			out: `time=2023-01-01 level=info msg=running module /a
+				{"ConfigPath": "/a/terragrunt.hcl", "WorkingDir": "/a"}
+				time=2023-01-01 level=info msg=running module /b
+				{"ConfigPath": "/b/terragrunt.hcl", "WorkingDir": "/b"}`,
+			want: []TerragruntInfo{
+				{ConfigPath: "/a/terragrunt.hcl", WorkingDir: "/a"},
+				{ConfigPath: "/b/terragrunt.hcl", WorkingDir: "/b"},
+			},
+		},
+		{
+			name: "extended fields",
+			out:  `{"ConfigPath": "/a/terragrunt.hcl", "WorkingDir": "/a", "TerraformBinary": "tofu", "IamRole": "arn:aws:iam::123:role/x", "DownloadDir": "/a/.terragrunt-cache/x"}`,
+			want: []TerragruntInfo{
+				{
+					ConfigPath:      "/a/terragrunt.hcl",
+					WorkingDir:      "/a",
+					TerraformBinary: "tofu",
+					IamRole:         "arn:aws:iam::123:role/x",
+					DownloadDir:     "/a/.terragrunt-cache/x",
+				},
+			},
+		},
+		{
+			name: "empty output",
+			out:  "",
+			want: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTerragruntInfoOutput([]byte(tt.out))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanupPlanFiles(t *testing.T) {
+	t.Run("no-op when planFile is empty", func(t *testing.T) {
+		err := cleanupPlanFiles([]string{"/a"}, []string{"/a/.terragrunt-cache/x"}, "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("removes plan file from both working dir and a diverging download dir", func(t *testing.T) {
+		workingDir := t.TempDir()
+		downloadDir := t.TempDir()
+
+		writeFile(t, workingDir+"/infracost-plan.json", "{}")
+		writeFile(t, downloadDir+"/infracost-plan.json", "{}")
+
+		err := cleanupPlanFiles([]string{workingDir}, []string{downloadDir}, "infracost-plan.json")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		assertRemoved(t, workingDir+"/infracost-plan.json")
+		assertRemoved(t, downloadDir+"/infracost-plan.json")
+	})
+
+	t.Run("tolerates a missing plan file", func(t *testing.T) {
+		workingDir := t.TempDir()
+
+		err := cleanupPlanFiles([]string{workingDir}, []string{""}, "infracost-plan.json")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("skips the download dir when it matches the working dir", func(t *testing.T) {
+		workingDir := t.TempDir()
+		writeFile(t, workingDir+"/infracost-plan.json", "{}")
+
+		err := cleanupPlanFiles([]string{workingDir}, []string{workingDir}, "infracost-plan.json")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		assertRemoved(t, workingDir+"/infracost-plan.json")
+	})
+}
+
+func TestParseTerragruntFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+		want []string
+	}{
+		{name: "empty", expr: "", want: nil},
+		{name: "blank", expr: "   ", want: nil},
+		{name: "single", expr: "envs/prod/app", want: []string{"envs/prod/app"}},
+		{name: "comma separated with whitespace", expr: " envs/prod/**, envs/staging/app ", want: []string{"envs/prod/**", "envs/staging/app"}},
+		{name: "drops empty entries", expr: "envs/prod/app,,envs/staging/app", want: []string{"envs/prod/app", "envs/staging/app"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseTerragruntFilter(tt.expr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerragruntFilterCLIArgs(t *testing.T) {
+	if got := terragruntFilterCLIArgs(nil); got != nil {
+		t.Errorf("got %#v, want nil for no patterns", got)
+	}
+
+	got := terragruntFilterCLIArgs([]string{"envs/prod/**", "envs/staging/app"})
+	want := []string{
+		"--terragrunt-include-external-dependencies=false", "--terragrunt-strict-include",
+		"--terragrunt-include-dir", "envs/prod/**",
+		"--terragrunt-include-dir", "envs/staging/app",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
+
+func TestFilterProjectDirs(t *testing.T) {
+	configDirs := []string{"/base/envs/prod/app", "/base/envs/staging/app"}
+	workingDirs := []string{"/work/prod", "/work/staging"}
+	downloadDirs := []string{"/dl/prod", "/dl/staging"}
+
+	t.Run("no patterns is a no-op", func(t *testing.T) {
+		gotConfig, gotWorking, gotDownload, err := filterProjectDirs("/base", configDirs, workingDirs, downloadDirs, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(gotConfig, configDirs) || !reflect.DeepEqual(gotWorking, workingDirs) || !reflect.DeepEqual(gotDownload, downloadDirs) {
+			t.Errorf("expected dirs to be returned unchanged")
+		}
+	})
+
+	t.Run("matches a subset by glob", func(t *testing.T) {
+		gotConfig, gotWorking, gotDownload, err := filterProjectDirs("/base", configDirs, workingDirs, downloadDirs, []string{"envs/prod/**"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(gotConfig, []string{"/base/envs/prod/app"}) {
+			t.Errorf("got configDirs %#v", gotConfig)
+		}
+		if !reflect.DeepEqual(gotWorking, []string{"/work/prod"}) {
+			t.Errorf("got workingDirs %#v", gotWorking)
+		}
+		if !reflect.DeepEqual(gotDownload, []string{"/dl/prod"}) {
+			t.Errorf("got downloadDirs %#v", gotDownload)
+		}
+	})
+
+	t.Run("errors when nothing matches", func(t *testing.T) {
+		_, _, _, err := filterProjectDirs("/base", configDirs, workingDirs, downloadDirs, []string{"envs/qa/**"})
+		if err == nil {
+			t.Fatal("expected an error when the filter matches 0 units")
+		}
+	})
+
+	t.Run("invalid glob pattern errors", func(t *testing.T) {
+		_, _, _, err := filterProjectDirs("/base", configDirs, workingDirs, downloadDirs, []string{"["})
+		if err == nil {
+			t.Fatal("expected an error for an invalid glob pattern")
+		}
+	})
+}